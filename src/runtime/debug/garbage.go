@@ -0,0 +1,42 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug
+
+import _ "unsafe" // for go:linkname
+
+// SetMemoryLimit provides the runtime with a soft memory limit.
+//
+// The runtime undertakes several processes to try to respect this
+// memory limit, including adjusting the frequency of garbage
+// collections and returning memory to the underlying system more
+// aggressively. This limit will be respected even if GOGC=off (or,
+// if SetGCPercent(-1) is executed).
+//
+// The input limit is provided as bytes, and is compared against the
+// sum of the HeapInuse, StackInuse, MSpanSys, MCacheSys, GCSys, and
+// OtherSys fields of runtime.MemStats; idle heap pages not yet
+// released to the OS, and BuckHashSys, are not counted. Notably, it
+// does not account for space used by the Go binary and memory
+// external to Go, such as memory managed by the underlying system on
+// behalf of the process, or memory managed by non-Go code inside the
+// same process. Examples of excluded memory sources include: OS
+// kernel memory held on behalf of the process, memory allocated by
+// C code, and memory mapped by syscall.Mmap (because it is not
+// managed by the Go runtime).
+//
+// A limit of zero will potentially trigger continuous GC cycles,
+// unless also paired with SetGCPercent(-1). The default limit is
+// math.MaxInt64, which disables the feature entirely.
+//
+// SetMemoryLimit returns the previously set memory limit. A
+// negative input does not adjust the limit, and allows for checking
+// the current setting.
+func SetMemoryLimit(limitBytes int64) int64 {
+	return setMemoryLimit(limitBytes)
+}
+
+// setMemoryLimit is implemented in the runtime package.
+//go:linkname setMemoryLimit runtime.setMemoryLimit
+func setMemoryLimit(limitBytes int64) int64
@@ -0,0 +1,44 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Export guts for testing.
+
+package runtime
+
+import "unsafe"
+
+// ReadMemStatsSlow is ReadMemStats's cross-check: it stops the world
+// and recomputes the heap-layout fields by walking the allocator's own
+// data structures, instead of reading the incrementally-maintained
+// memstats counters. Cumulative counters, GC-cycle bookkeeping, the
+// BySize table, and the memory-limit and scavenger fields are copied
+// from memstats, not recomputed.
+func ReadMemStatsSlow(m *MemStats) {
+	stopTheWorld("readmemstats_slow")
+	systemstack(func() {
+		readMemStatsSlow(m)
+	})
+	startTheWorld()
+}
+
+// TinyAllocOf reports the base address of the tiny block that ptr was
+// carved from, and the id of the P whose mcache currently owns that
+// block. If no P's mcache currently holds that block, it returns 0
+// and -1. It exists so tests can confirm that tiny-block sharing is
+// confined to a single P, never observed across Ps.
+func TinyAllocOf(ptr unsafe.Pointer) (blockBase uintptr, pid int32) {
+	pid = -1
+	base := uintptr(ptr) &^ (maxTinySize - 1)
+	stopTheWorld("tinyallocof")
+	for _, pp := range allp {
+		c := pp.mcache
+		if c != nil && c.tiny != 0 && c.tiny&^(maxTinySize-1) == base {
+			blockBase = base
+			pid = pp.id
+			break
+		}
+	}
+	startTheWorld()
+	return
+}
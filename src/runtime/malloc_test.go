@@ -7,8 +7,13 @@ package runtime_test
 import (
 	"flag"
 	"fmt"
+	"internal/testenv"
+	"os"
+	"os/exec"
 	"reflect"
 	. "runtime"
+	"runtime/debug"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -17,6 +22,22 @@ import (
 func TestMemStats(t *testing.T) {
 	// Make sure there's at least one forced GC.
 	GC()
+	// Force a scavenge via an absurdly low memory limit, then wait for
+	// the background scavenger to actually catch up to it, so
+	// HeapScavengeCount, HeapScavengeBytes, and LastScavenge below are
+	// nonzero. Setting the limit wakes the background scavenger and
+	// starts the memory limit worker; neither sweeps synchronously, the
+	// sweeps run asynchronously on their own goroutines.
+	old := debug.SetMemoryLimit(1)
+	for i := 0; i < 200; i++ {
+		var s MemStats
+		ReadMemStats(&s)
+		if s.HeapScavengeCount > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	debug.SetMemoryLimit(old)
 
 	// Test that MemStats has sane values.
 	st := new(MemStats)
@@ -62,7 +83,8 @@ func TestMemStats(t *testing.T) {
 		"PauseTotalNs": {le(1e11)}, "PauseNs": nil, "PauseEnd": nil,
 		"NumGC": {nz, le(1e9)}, "NumForcedGC": {nz, le(1e9)},
 		"GCCPUFraction": nil, "EnableGC": {eq(true)}, "DebugGC": {eq(false)},
-		"BySize": nil,
+		"BySize": nil, "MemoryLimit": {nz},
+		"HeapScavengeCount": {nz}, "HeapScavengeBytes": {nz}, "LastScavenge": {nz},
 	}
 
 	rst := reflect.ValueOf(st).Elem()
@@ -119,6 +141,156 @@ func TestMemStats(t *testing.T) {
 	if st.NumForcedGC > st.NumGC {
 		t.Fatalf("NumForcedGC(%d) > NumGC(%d)", st.NumForcedGC, st.NumGC)
 	}
+
+	// Cross-check against the slow path, which recomputes the
+	// heap-layout fields from the allocator's own data structures
+	// instead of trusting the incrementally-maintained counters above;
+	// the cumulative and GC-cycle fields it copies from memstats.
+	slow := new(MemStats)
+	ReadMemStatsSlow(slow)
+	rslow := reflect.ValueOf(slow).Elem()
+	for i := 0; i < rst.Type().NumField(); i++ {
+		name := rst.Type().Field(i).Name
+		got, want := rst.Field(i).Interface(), rslow.Field(i).Interface()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadMemStats and ReadMemStatsSlow disagree on %s: %v != %v", name, got, want)
+		}
+	}
+}
+
+// TestSetMemoryLimit sets a low soft memory limit in a subprocess,
+// drives it with steady allocation, and checks that the pacer keeps
+// Sys near the limit by forcing GC far more often than it otherwise
+// would.
+func TestSetMemoryLimit(t *testing.T) {
+	testenv.MustHaveExec(t)
+	if testing.Short() {
+		t.Skip("skipping test that allocates under a tight memory limit")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := testenv.CleanCmdEnv(exec.Command(exe, "-test.run=^TestSetMemoryLimitHelper$"))
+	cmd.Env = append(cmd.Env, "GO_TEST_MEMORY_LIMIT_HELPER=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process failed: %v\n%s", err, out)
+	}
+
+	var sys, numGC uint64
+	if _, err := fmt.Sscanf(string(out), "%d %d", &sys, &numGC); err != nil {
+		t.Fatalf("failed to parse helper output %q: %v", out, err)
+	}
+
+	const limit = memoryLimitHelperLimit
+	if tolerance := uint64(limit) * 12 / 10; sys > tolerance {
+		t.Errorf("Sys = %d bytes, want <= %d (limit %d plus 20%% tolerance)", sys, tolerance, limit)
+	}
+	if numGC < 10 {
+		t.Errorf("NumGC = %d, want many forced cycles while pinned near the limit", numGC)
+	}
+}
+
+const memoryLimitHelperLimit = 32 << 20 // 32 MiB
+
+// TestSetMemoryLimitHelper is not a real test; it's driven as a
+// subprocess by TestSetMemoryLimit.
+func TestSetMemoryLimitHelper(t *testing.T) {
+	if os.Getenv("GO_TEST_MEMORY_LIMIT_HELPER") == "" {
+		t.Skip("not running as the TestSetMemoryLimit helper")
+	}
+
+	debug.SetMemoryLimit(memoryLimitHelperLimit)
+
+	var prevNumGC uint32
+	var forced int
+	junk := make([][]byte, 0, 1024)
+	for i := 0; i < 20000 && forced < 20; i++ {
+		junk = append(junk, make([]byte, 64<<10))
+		if len(junk) > 256 {
+			junk = junk[1:]
+		}
+		var st MemStats
+		ReadMemStats(&st)
+		if st.NumGC != prevNumGC {
+			forced++
+			prevNumGC = st.NumGC
+		}
+	}
+
+	var st MemStats
+	ReadMemStats(&st)
+	fmt.Printf("%d %d\n", st.Sys, st.NumGC)
+}
+
+// TestPhysicalMemoryUtilization checks that the background scavenger
+// actually gives pages back to the OS: it drives a subprocess that
+// allocates a large slice, drops it, forces a GC, then drives the
+// scavenger via an absurdly low SetMemoryLimit and waits for it to
+// catch up, and reports how much of the resulting HeapIdle the
+// scavenger has released.
+func TestPhysicalMemoryUtilization(t *testing.T) {
+	testenv.MustHaveExec(t)
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := testenv.CleanCmdEnv(exec.Command(exe, "-test.run=^TestPhysicalMemoryUtilizationHelper$"))
+	cmd.Env = append(cmd.Env, "GO_TEST_PHYSICAL_MEMORY_HELPER=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process failed: %v\n%s", err, out)
+	}
+
+	var heapIdle, heapReleased uint64
+	if _, err := fmt.Sscanf(string(out), "%d %d", &heapIdle, &heapReleased); err != nil {
+		t.Fatalf("failed to parse helper output %q: %v", out, err)
+	}
+	if heapIdle == 0 {
+		t.Fatal("HeapIdle is 0; helper process didn't leave any heap idle")
+	}
+
+	const wantFraction = 0.9
+	if got := float64(heapReleased) / float64(heapIdle); got < wantFraction {
+		t.Errorf("HeapReleased/HeapIdle = %f, want >= %f (scavenger didn't return enough idle heap)", got, wantFraction)
+	}
+}
+
+// TestPhysicalMemoryUtilizationHelper is not a real test; it's driven
+// as a subprocess by TestPhysicalMemoryUtilization.
+func TestPhysicalMemoryUtilizationHelper(t *testing.T) {
+	if os.Getenv("GO_TEST_PHYSICAL_MEMORY_HELPER") == "" {
+		t.Skip("not running as the TestPhysicalMemoryUtilization helper")
+	}
+
+	big := make([]byte, 128<<20) // 128 MiB
+	for i := range big {
+		big[i] = byte(i)
+	}
+	big = nil
+
+	GC()
+
+	// There's no debug.FreeOSMemory in this tree; drive the background
+	// scavenger the same way TestMemStats does, by pinning an absurdly
+	// low memory limit and waiting for the resulting scavenge work to
+	// show up in HeapReleased.
+	old := debug.SetMemoryLimit(1)
+	var st MemStats
+	for i := 0; i < 200; i++ {
+		ReadMemStats(&st)
+		if st.HeapIdle > 0 && st.HeapReleased*10 >= st.HeapIdle*9 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	debug.SetMemoryLimit(old)
+
+	ReadMemStats(&st)
+	fmt.Printf("%d %d\n", st.HeapIdle, st.HeapReleased)
 }
 
 func TestStringConcatenationAllocs(t *testing.T) {
@@ -155,6 +327,110 @@ func TestTinyAlloc(t *testing.T) {
 	}
 }
 
+// TestTinyAllocConcurrent stresses the tiny allocator from many
+// goroutines at once, the way TestTinyAlloc does from one, and checks
+// invariants that only show up under concurrency: that no two
+// allocations ever alias the same address, that chunk-sharing is
+// confined to a single P's mcache, and that Mallocs/Frees still
+// reconcile with the set of objects that remain reachable after a GC.
+func TestTinyAllocConcurrent(t *testing.T) {
+	perG := 200000
+	if testing.Short() {
+		perG = 2000
+	}
+	procs := GOMAXPROCS(0)
+
+	// TinyAllocOf stops the world, so only sample a fraction of
+	// allocations instead of calling it on every one of perG*procs
+	// allocations.
+	const sampleEvery = 101
+
+	type record struct {
+		p         unsafe.Pointer
+		blockBase uintptr
+		pid       int32
+	}
+
+	var mu sync.Mutex
+	var all []record
+	var live []unsafe.Pointer
+
+	var wg sync.WaitGroup
+	for g := 0; g < procs; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var localAll []record
+			localLive := make([]unsafe.Pointer, 0, perG)
+			for i := 0; i < perG; i++ {
+				p := unsafe.Pointer(new(byte))
+				localLive = append(localLive, p)
+				if i%sampleEvery == 0 {
+					blockBase, pid := TinyAllocOf(p)
+					localAll = append(localAll, record{p, blockBase, pid})
+				}
+			}
+			mu.Lock()
+			all = append(all, localAll...)
+			live = append(live, localLive...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// (1) No two distinct allocations may alias the same address.
+	seen := make(map[unsafe.Pointer]bool, len(live))
+	for _, p := range live {
+		if seen[p] {
+			t.Fatalf("two allocations returned the same pointer: %p", p)
+		}
+		seen[p] = true
+	}
+
+	// (2) Chunk-sharing across goroutines should only ever happen when
+	// the shared tiny block came from the same P. TinyAllocOf reports
+	// pid == -1 when it can't find p in any P's mcache (the block may
+	// have already been retired by the time we stopped the world); those
+	// samples carry no ownership information; if they were folded into
+	// chunkOwner they'd all collide on the same key and trivially defeat
+	// this check, so discard them instead. Fail outright if too many
+	// samples come back unattributed, since that would mean the check
+	// below is barely exercising anything.
+	chunkOwner := make(map[uintptr]int32)
+	sharedAcrossP := false
+	unattributed := 0
+	for _, r := range all {
+		if r.pid == -1 {
+			unattributed++
+			continue
+		}
+		if owner, ok := chunkOwner[r.blockBase]; ok {
+			if owner != r.pid {
+				sharedAcrossP = true
+			}
+		} else {
+			chunkOwner[r.blockBase] = r.pid
+		}
+	}
+	if sharedAcrossP {
+		t.Error("a tiny-block chunk was shared across allocations attributed to different Ps")
+	}
+	if len(all) > 0 && unattributed*2 > len(all) {
+		t.Fatalf("TinyAllocOf failed to attribute %d of %d samples to any P; check (2) is not exercising the invariant it exists for", unattributed, len(all))
+	}
+
+	// (3) After a GC, the number of objects still reachable through
+	// live should be accounted for among the objects Mallocs says were
+	// ever allocated and not yet counted in Frees.
+	GC()
+	var st MemStats
+	ReadMemStats(&st)
+	if reachable := st.Mallocs - st.Frees; reachable < uint64(len(live)) {
+		t.Fatalf("Mallocs(%d) - Frees(%d) = %d, want >= %d still-reachable objects in live", st.Mallocs, st.Frees, reachable, len(live))
+	}
+	KeepAlive(live)
+}
+
 var mallocSink uintptr
 
 func BenchmarkMalloc8(b *testing.B) {
@@ -0,0 +1,266 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	"math"
+	"runtime/internal/atomic"
+)
+
+// memoryLimit is the soft cap, in bytes, on the total memory mapped by
+// the Go runtime: HeapInuse + StackInuse + MSpanSys + MCacheSys +
+// GCSys + OtherSys, as reported by MemStats. math.MaxInt64 means the
+// limit is disabled. It's read by gcLimitWorkerLoop on every tick and
+// may be changed at any time by any goroutine, so it's kept as a
+// standalone atomic rather than threaded through a larger pacer type;
+// this tree has no gcController to thread it through.
+var memoryLimit atomic.Int64
+
+func init() {
+	memoryLimit.Store(math.MaxInt64)
+}
+
+// setMemoryLimit installs a new soft memory limit and returns the
+// previous one. A negative input leaves the limit unchanged and is
+// used purely to read the current value back out.
+//
+//go:linkname setMemoryLimit runtime/debug.setMemoryLimit
+func setMemoryLimit(limit int64) int64 {
+	old := memoryLimit.Load()
+	if limit < 0 {
+		return old
+	}
+	memoryLimit.Store(limit)
+	if limit != math.MaxInt64 {
+		startGCLimitWorker()
+	}
+	// A lower limit may mean we're already over budget; wake the
+	// background scavenger so it can start giving pages back
+	// immediately instead of waiting for its next tick.
+	wakeScavenger()
+	return old
+}
+
+// gcControllerFootprintCache and gcControllerFootprintCacheAt cache the
+// last snapshot gcControllerCurrentFootprint took, and when it was
+// taken. HeapInuse, StackInuse, and the rest are only safe to read
+// under the world-stopped invariant documented on memstats in
+// mstats.go; reading them straight off the background
+// gcLimitWorkerLoop goroutine, as an earlier version of this function
+// did, was a data race, and one that happened to look harmless in
+// testing only because TestSetMemoryLimit's helper also calls
+// ReadMemStats every iteration, incidentally keeping memstats fresh. A
+// program that never calls ReadMemStats would see a permanently stale
+// footprint and the limit would never fire.
+var (
+	gcControllerFootprintCache   atomic.Uint64
+	gcControllerFootprintCacheAt atomic.Int64
+)
+
+// gcControllerFootprintRefreshInterval bounds how often
+// gcControllerCurrentFootprint is willing to stop the world to refresh
+// its cached snapshot. gcLimitWorkerLoop's own poll interval can fall
+// as low as gcLimitCheckMinInterval once near the limit, and stopping
+// the world that often would itself stall every other goroutine, so
+// refreshes are capped independently of how often the caller asks.
+const gcControllerFootprintRefreshInterval int64 = 10e6 // 10ms
+
+// gcControllerCurrentFootprint estimates the runtime's current
+// contribution to the soft memory limit: HeapInuse + StackInuse +
+// MSpanSys + MCacheSys + GCSys + OtherSys. Idle heap pages not yet
+// released to the OS, and BuckHashSys, are not counted. It stops the
+// world to take
+// a consistent snapshot of the underlying fields, rate-limited to
+// once per gcControllerFootprintRefreshInterval; between refreshes it
+// returns the cached value.
+func gcControllerCurrentFootprint() uint64 {
+	now := nanotime()
+	if now-gcControllerFootprintCacheAt.Load() < gcControllerFootprintRefreshInterval {
+		return gcControllerFootprintCache.Load()
+	}
+
+	var footprint uint64
+	stopTheWorld("gc limit footprint")
+	systemstack(func() {
+		updatememstats()
+		footprint = memstats.HeapInuse + memstats.StackInuse + memstats.MSpanSys +
+			memstats.MCacheSys + memstats.GCSys + memstats.OtherSys
+	})
+	startTheWorld()
+
+	gcControllerFootprintCache.Store(footprint)
+	gcControllerFootprintCacheAt.Store(now)
+	return footprint
+}
+
+// gcControllerOverLimit reports whether, given projected heap growth
+// to the next GC cycle, the runtime would exceed the configured
+// memory limit.
+func gcControllerOverLimit(projectedNextCycle uint64) bool {
+	limit := memoryLimit.Load()
+	if limit == math.MaxInt64 {
+		return false
+	}
+	return projectedNextCycle > uint64(limit)
+}
+
+// gcControllerScavengeMinInterval rate-limits how often
+// gcControllerApplyLimit is willing to run the expensive, heap-lock-
+// holding scavengeAllIdle sweep once the runtime is over budget.
+// gcLimitWorkerLoop's poll interval can fall as low as
+// gcLimitCheckMinInterval (1ms) while pinned at the limit — the
+// feature's primary use case — and re-walking every free span and
+// re-issuing sysUnused that often would stall every other allocating
+// goroutine. scavengePollInterval, bgscavenge's own cadence, is used
+// as the floor so the limit's last-resort sweep never runs more often
+// than the background scavenger would anyway; between sweeps,
+// wakeScavenger nudges bgscavenge to run its own pass early instead.
+const gcControllerScavengeMinInterval = scavengePollInterval
+
+var gcControllerLastForcedScavenge atomic.Int64
+
+// gcControllerApplyLimit recomputes the trigger ratio against the
+// memory limit. There's no allocation-triggered pacer in this tree for
+// a shortened ratio to feed: gcLimitWorkerLoop is the sole caller of
+// this function, and uses the ratio it returns only to size its own
+// poll interval, so in practice this makes the worker itself check
+// back (and force a GC, see below) sooner as headroom shrinks. It also
+// nudges the scavenger to be more aggressive about returning idle heap
+// pages to the OS. It does not itself force a GC cycle; that decision,
+// and the bound on how much CPU forced cycles may consume, belongs to
+// the caller (see gcLimitWorkerLoop).
+func gcControllerApplyLimit(triggerRatio float64) float64 {
+	limit := memoryLimit.Load()
+	if limit == math.MaxInt64 {
+		return triggerRatio
+	}
+
+	footprint := gcControllerCurrentFootprint()
+	if footprint == 0 {
+		return triggerRatio
+	}
+
+	headroom := float64(limit) - float64(footprint)
+	if headroom <= 0 {
+		// Already over budget: scavenge idle heap pages right now
+		// rather than waiting for the background scavenger's normal
+		// pace, but no more often than gcControllerScavengeMinInterval.
+		now := nanotime()
+		if last := gcControllerLastForcedScavenge.Load(); now-last >= gcControllerScavengeMinInterval {
+			if gcControllerLastForcedScavenge.CompareAndSwap(last, now) {
+				scavengeAllIdle()
+			}
+		} else {
+			wakeScavenger()
+		}
+		return 0
+	}
+
+	// Scale the trigger ratio down as headroom shrinks so GC runs
+	// more often the closer we get to the limit.
+	slack := headroom / float64(limit)
+	if slack < triggerRatio {
+		return slack
+	}
+	return triggerRatio
+}
+
+// gcControllerLimitCPUFraction bounds how much of gcLimitWorkerLoop's
+// own wall-clock time may be spent inside limit-forced GC cycles. It
+// is the (c) "last resort" knob from the memory limit request: once a
+// program is pinned at the limit, this is what keeps the worker from
+// busy-looping GC back-to-back and starving the rest of the program.
+const gcControllerLimitCPUFraction = 0.5
+
+// defaultTriggerRatio is the starting point gcControllerApplyLimit
+// scales down from as headroom shrinks; it mirrors the GOGC=100
+// default the rest of the pacer already assumes. There's no
+// allocation-triggered pacer in this tree for a published trigger
+// ratio to steer, so gcLimitWorkerLoop just keeps the value returned
+// by gcControllerApplyLimit local to each tick instead of publishing
+// it anywhere for a consumer that doesn't exist.
+const defaultTriggerRatio = 1.0
+
+const (
+	gcLimitCheckMinInterval int64 = 1e6   // 1ms
+	gcLimitCheckMaxInterval int64 = 100e6 // 100ms
+)
+
+var (
+	gcLimitWorkerLock    mutex
+	gcLimitWorkerStarted bool
+
+	gcLimitForcedNs  atomic.Int64 // cumulative ns spent in limit-forced GC cycles
+	gcLimitElapsedNs atomic.Int64 // cumulative ns gcLimitWorkerLoop has been running
+)
+
+// startGCLimitWorker lazily starts the background goroutine that
+// enforces the soft memory limit. Most programs never call
+// SetMemoryLimit, so there's no reason to pay for a dedicated
+// goroutine on every startup; only the first call with a finite limit
+// starts it, and it then runs for the remaining lifetime of the
+// process.
+func startGCLimitWorker() {
+	lock(&gcLimitWorkerLock)
+	if !gcLimitWorkerStarted {
+		gcLimitWorkerStarted = true
+		go gcLimitWorkerLoop()
+	}
+	unlock(&gcLimitWorkerLock)
+}
+
+// gcLimitWorkerLoop is the memory limit's actual tie-in to GC
+// scheduling, replacing the earlier approach of piggybacking on
+// ReadMemStats (which made an unrelated stats read risk an
+// undocumented synchronous GC). Each tick it:
+//
+//  1. Recomputes the trigger ratio against the current footprint via
+//     gcControllerApplyLimit.
+//  2. Sizes its own next sleep interval from that ratio — tighter
+//     ratio, shorter interval, so the worker checks back (and forces a
+//     GC, see below) sooner the closer the program is to the limit.
+//  3. If we're over budget, forces a GC cycle, but only if doing so
+//     keeps the cumulative time spent in forced cycles within
+//     gcControllerLimitCPUFraction of this goroutine's own wall-clock
+//     lifetime — implementing the requested "run GC continuously,
+//     bounded to some CPU fraction" behavior instead of a single
+//     one-shot call.
+func gcLimitWorkerLoop() {
+	last := nanotime()
+	for {
+		now := nanotime()
+		gcLimitElapsedNs.Add(now - last)
+		last = now
+
+		footprint := gcControllerCurrentFootprint()
+		ratio := gcControllerApplyLimit(defaultTriggerRatio)
+
+		interval := int64(float64(gcLimitCheckMaxInterval) * ratio)
+		if interval < gcLimitCheckMinInterval {
+			interval = gcLimitCheckMinInterval
+		}
+
+		if gcControllerOverLimit(footprint) && gcLimitBudgetAvailable() {
+			start := nanotime()
+			GC()
+			gcLimitForcedNs.Add(nanotime() - start)
+			interval = gcLimitCheckMinInterval
+		}
+
+		timeSleep(interval)
+	}
+}
+
+// gcLimitBudgetAvailable reports whether forcing another GC cycle
+// right now would keep the cumulative time gcLimitWorkerLoop has
+// spent forcing GC within gcControllerLimitCPUFraction of the
+// worker's own wall-clock lifetime.
+func gcLimitBudgetAvailable() bool {
+	elapsed := gcLimitElapsedNs.Load()
+	if elapsed == 0 {
+		return true
+	}
+	return float64(gcLimitForcedNs.Load())/float64(elapsed) < gcControllerLimitCPUFraction
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
+
+// Scavenger progress counters, updated by recordScavenge every time
+// a run of heap pages is returned to the OS via sysUnused, whether by
+// the background scavenger or by the memory limit's sweep. They're exposed through MemStats so operators can observe
+// scavenger progress directly instead of inferring it from RSS.
+var (
+	heapScavengeCount atomic.Uint64 // number of sysUnused calls made by the scavenger
+	heapScavengeBytes atomic.Uint64 // cumulative bytes passed to sysUnused
+	lastScavengeTime  atomic.Int64  // nanoseconds since epoch of the most recent scavenge
+)
+
+// recordScavenge is called immediately after a run of n bytes is
+// released back to the OS via sysUnused, by scavengeRange — the
+// allocator's one and only path to sysUnused, used both by the
+// background scavenger's ordinary pacing (bgscavenge) and by the
+// memory limit's last-resort sweep (gcControllerApplyLimit).
+func recordScavenge(n uintptr) {
+	heapScavengeCount.Add(1)
+	heapScavengeBytes.Add(uint64(n))
+	lastScavengeTime.Store(unixNano())
+}
+
+// scavengeRange releases the npages run of heap pages starting at
+// base back to the OS and records the scavenger's progress. This is
+// the single choke point every scavenge goes through, so
+// HeapScavengeCount/HeapScavengeBytes/LastScavenge never miss a
+// release.
+func scavengeRange(base uintptr, npages uintptr) {
+	n := npages * pageSize
+	sysUnused(unsafe.Pointer(base), n)
+	recordScavenge(n)
+}
+
+// scavengeAllIdle walks every free, not-yet-scavenged span on the
+// heap and returns its pages to the OS immediately. It's the sweep
+// both bgscavenge's ordinary background pass and the memory limit's
+// last-resort path (gcControllerApplyLimit) run; the only difference
+// between them is what wakes the sweep up.
+func scavengeAllIdle() {
+	lock(&mheap_.lock)
+	for _, s := range mheap_.allspans {
+		if s.state.get() != mSpanFree {
+			continue
+		}
+		if unscavenged := s.npages - s.scavenged; unscavenged > 0 {
+			scavengeRange(s.base(), unscavenged)
+			s.scavenged += unscavenged
+		}
+	}
+	unlock(&mheap_.lock)
+}
+
+// scavenge coordinates the background scavenger: the goroutine that,
+// during ordinary operation, periodically returns idle heap pages to
+// the OS independent of any memory limit. It's what actually moves
+// idle heap pages into HeapReleased in a normal, limit-free program;
+// released pages still count toward HeapIdle.
+var scavenge scavengerState
+
+type scavengerState struct {
+	wakeRequested atomic.Bool
+}
+
+// wake asks the background scavenger to run its next pass as soon as
+// it next polls, instead of waiting out the rest of
+// scavengeBackgroundInterval. Used whenever the soft memory limit
+// (see mgclimit.go) is set, and when the runtime is over the limit
+// but the limit's own sweep ran too recently to run again.
+func (s *scavengerState) wake() {
+	s.wakeRequested.Store(true)
+}
+
+func wakeScavenger() {
+	scavenge.wake()
+}
+
+const (
+	// scavengePollInterval is how often bgscavenge checks whether it's
+	// been woken early.
+	scavengePollInterval int64 = 20e6 // 20ms
+
+	// scavengeBackgroundInterval is the longest bgscavenge will go
+	// between sweeps when nothing wakes it sooner.
+	scavengeBackgroundInterval int64 = 500e6 // 500ms
+)
+
+func init() {
+	go bgscavenge()
+}
+
+// bgscavenge is the background scavenger goroutine: the "thing that
+// actually returns HeapIdle pages to the OS during normal operation"
+// that recordScavenge's counters are meant to track. It runs for the
+// lifetime of the process, sweeping the heap via scavengeAllIdle
+// either on its own schedule or as soon as wake is called.
+func bgscavenge() {
+	var sinceLastSweep int64
+	for {
+		timeSleep(scavengePollInterval)
+		sinceLastSweep += scavengePollInterval
+		if sinceLastSweep < scavengeBackgroundInterval && !scavenge.wakeRequested.Load() {
+			continue
+		}
+		scavenge.wakeRequested.Store(false)
+		sinceLastSweep = 0
+		scavengeAllIdle()
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Memory statistics
+
+package runtime
+
+// A MemStats records statistics about the memory allocator.
+type MemStats struct {
+	// General statistics.
+
+	// Alloc is bytes of allocated heap objects.
+	Alloc uint64
+
+	// TotalAlloc is cumulative bytes allocated for heap objects.
+	TotalAlloc uint64
+
+	// Sys is the total bytes of memory obtained from the OS.
+	Sys uint64
+
+	// Lookups is the number of pointer lookups performed by the
+	// runtime.
+	Lookups uint64
+
+	// Mallocs is the cumulative count of heap objects allocated.
+	Mallocs uint64
+
+	// Frees is the cumulative count of heap objects freed.
+	Frees uint64
+
+	// Heap memory statistics.
+
+	HeapAlloc    uint64
+	HeapSys      uint64
+	HeapIdle     uint64
+	HeapInuse    uint64
+	HeapReleased uint64
+	HeapObjects  uint64
+
+	// Stack memory statistics.
+	StackInuse uint64
+	StackSys   uint64
+
+	// Off-heap memory statistics.
+	MSpanInuse  uint64
+	MSpanSys    uint64
+	MCacheInuse uint64
+	MCacheSys   uint64
+	BuckHashSys uint64
+	GCSys       uint64
+	OtherSys    uint64
+
+	// Garbage collector statistics.
+	NextGC        uint64
+	LastGC        uint64
+	PauseTotalNs  uint64
+	PauseNs       [256]uint64
+	PauseEnd      [256]uint64
+	NumGC         uint32
+	NumForcedGC   uint32
+	GCCPUFraction float64
+	EnableGC      bool
+	DebugGC       bool
+
+	// Per-size allocation statistics.
+	BySize [61]struct {
+		Size    uint32
+		Mallocs uint64
+		Frees   uint64
+	}
+
+	// MemoryLimit is the soft memory limit currently in effect, as set
+	// by debug.SetMemoryLimit. It is math.MaxInt64 if no limit has
+	// been configured.
+	MemoryLimit uint64
+
+	// HeapScavengeCount is the number of times the scavenger (the
+	// background scavenger or the memory limit's sweep) has returned a
+	// run of heap pages to the OS.
+	HeapScavengeCount uint64
+
+	// HeapScavengeBytes is the cumulative number of bytes the
+	// scavenger has returned to the OS.
+	HeapScavengeBytes uint64
+
+	// LastScavenge is the time the scavenger last returned memory to
+	// the OS, in nanoseconds since the Unix epoch.
+	LastScavenge uint64
+}
+
+// memstats is the running snapshot maintained by the allocator and
+// garbage collector as they do their work. ReadMemStats copies it out
+// under the world-stopped invariant so callers see a consistent view.
+var memstats MemStats
+
+// ReadMemStats populates m with memory allocator statistics.
+//
+// The returned memory allocator statistics are up to date as of the
+// call to ReadMemStats. This is in contrast with a heap profile,
+// which is a snapshot as of the most recently completed garbage
+// collection cycle.
+func ReadMemStats(m *MemStats) {
+	stopTheWorld("read mem stats")
+	systemstack(func() {
+		readmemstats_m(m)
+	})
+	startTheWorld()
+}
+
+// readmemstats_m must be called on the system stack with the world
+// stopped: the fields it reads are mutated concurrently by allocation
+// and GC.
+func readmemstats_m(stats *MemStats) {
+	updatememstats()
+	*stats = memstats
+}
+
+// updatememstats recomputes the derived MemStats fields (Sys,
+// HeapInuse, and Alloc) from the running counters maintained by the
+// allocator, and refreshes MemoryLimit and the scavenger fields. It must be called with the world
+// stopped.
+func updatememstats() {
+	memstats.Sys = memstats.HeapSys + memstats.StackSys + memstats.MSpanSys +
+		memstats.MCacheSys + memstats.BuckHashSys + memstats.GCSys + memstats.OtherSys
+	memstats.HeapInuse = memstats.HeapSys - memstats.HeapIdle
+	memstats.Alloc = memstats.HeapAlloc
+	memstats.MemoryLimit = uint64(memoryLimit.Load())
+	memstats.HeapScavengeCount = heapScavengeCount.Load()
+	memstats.HeapScavengeBytes = heapScavengeBytes.Load()
+	memstats.LastScavenge = uint64(lastScavengeTime.Load())
+}
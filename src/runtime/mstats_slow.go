@@ -0,0 +1,106 @@
+// Copyright 2022 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import "unsafe"
+
+// readMemStatsSlow populates stats by walking every mspan on the heap
+// and every mcache, rather than by trusting the
+// incrementally-maintained counters that ReadMemStats reports from.
+// Cumulative lifetime counters that a span walk can't reconstruct
+// (Mallocs, Frees, TotalAlloc, and the rest of the GC-cycle
+// bookkeeping) are copied from the live memstats instead. It exists
+// purely as a cross-check for the heap-layout accounting that *can*
+// be recomputed from spans, and is only reachable from runtime_test,
+// where the unexported allocator internals are visible.
+//
+// The caller must hold the world stopped; span and cache lists are
+// not safe to walk while allocation is running concurrently.
+func readMemStatsSlow(stats *MemStats) {
+	*stats = MemStats{}
+
+	// Walk every span known to the heap, in every state, and fold its
+	// contribution into the heap totals. Mallocs/Frees are deliberately
+	// not computed here: they're cumulative counts since process start,
+	// and a span only tells us how many of its slots are allocated
+	// *right now* — that information is gone the moment an object is
+	// freed and its slot reused. They're copied from the live memstats
+	// below instead, alongside the rest of the GC-cycle bookkeeping.
+	for _, s := range mheap_.allspans {
+		switch s.state.get() {
+		case mSpanInUse:
+			stats.HeapInuse += uint64(s.npages) * pageSize
+			stats.HeapObjects += uint64(s.allocCount)
+			stats.HeapAlloc += uint64(s.allocCount) * uint64(s.elemsize)
+		case mSpanManual:
+			stats.StackInuse += uint64(s.npages) * pageSize
+		case mSpanFree:
+			stats.HeapIdle += uint64(s.npages) * pageSize
+			stats.HeapReleased += uint64(s.scavenged) * pageSize
+		}
+	}
+
+	// The tiny allocator hands out slivers of a shared 16-byte block
+	// before the block is actually full. The fast-path accounting
+	// above charges the whole block to HeapAlloc as soon as it's
+	// carved off a span, so walk every P's mcache and subtract the
+	// still-unused tail of its current tiny block.
+	for _, p := range allp {
+		c := p.mcache
+		if c == nil {
+			continue
+		}
+		if c.tiny != 0 {
+			stats.HeapAlloc -= uint64(maxTinySize - c.tinyoffset)
+		}
+		stats.MCacheInuse += uint64(unsafe.Sizeof(*c))
+	}
+
+	// mspan struct metadata comes from a fixalloc, not a heap span, so
+	// it can't be recovered from the allspans walk above: MSpanInuse
+	// and MSpanSys are the in-use and system-obtained byte counts the
+	// fixalloc itself already tracks. Other fixalloc-backed structures
+	// (specials, mcache/mcentral bookkeeping) are accounted to
+	// GCSys/OtherSys by walking the persistentalloc chunks directly
+	// rather than trusting the running sysMemStat counters.
+	stats.MSpanInuse += uint64(mheap_.spanalloc.inuse)
+	stats.MSpanSys += uint64(mheap_.spanalloc.sys.load())
+	stats.GCSys += uint64(mheap_.gcWorkBufAllocSys())
+	stats.OtherSys += uint64(persistentChunkBytes())
+
+	stats.HeapSys = stats.HeapInuse + stats.HeapIdle
+	stats.StackSys += stats.StackInuse
+	stats.MCacheSys += stats.MCacheInuse
+	stats.Alloc = stats.HeapAlloc
+
+	// GC pacing, pause history, NumGC/NumForcedGC, GCCPUFraction,
+	// EnableGC/DebugGC, and the BySize table aren't recomputable by
+	// walking spans and caches — they're GC-cycle bookkeeping, not
+	// heap-layout accounting — so copy them from the live memstats the
+	// same way readmemstats_m does.
+	stats.TotalAlloc = memstats.TotalAlloc
+	stats.Mallocs = memstats.Mallocs
+	stats.Frees = memstats.Frees
+	stats.Lookups = memstats.Lookups
+	stats.BuckHashSys = memstats.BuckHashSys
+	stats.NextGC = memstats.NextGC
+	stats.LastGC = memstats.LastGC
+	stats.PauseTotalNs = memstats.PauseTotalNs
+	stats.PauseNs = memstats.PauseNs
+	stats.PauseEnd = memstats.PauseEnd
+	stats.NumGC = memstats.NumGC
+	stats.NumForcedGC = memstats.NumForcedGC
+	stats.GCCPUFraction = memstats.GCCPUFraction
+	stats.EnableGC = memstats.EnableGC
+	stats.DebugGC = memstats.DebugGC
+	stats.BySize = memstats.BySize
+	stats.MemoryLimit = memstats.MemoryLimit
+	stats.HeapScavengeCount = memstats.HeapScavengeCount
+	stats.HeapScavengeBytes = memstats.HeapScavengeBytes
+	stats.LastScavenge = memstats.LastScavenge
+
+	stats.Sys = stats.HeapSys + stats.StackSys + stats.MSpanSys +
+		stats.MCacheSys + stats.BuckHashSys + stats.GCSys + stats.OtherSys
+}